@@ -32,6 +32,9 @@ import (
 )
 
 func runQodanaLocal(opts *QodanaOptions) int {
+	if len(opts.Products) > 1 {
+		return runQodanaLocalMultiProduct(opts)
+	}
 	args := []string{quoteForWindows(Prod.IdeScript), "inspect", "qodana", "--stub-profile", quoteForWindows(opts.stabProfilePath())}
 	args = append(args, quoteForWindows(opts.ProjectDir), quoteForWindows(opts.ResultsDir))
 	args = append(args, getIdeArgs(opts)...)
@@ -101,12 +104,23 @@ func getIdeArgs(opts *QodanaOptions) []string {
 	for _, property := range opts.Property {
 		arguments = append(arguments, "--property="+property)
 	}
+	if backend := getBackend(Prod.BaseScriptName); backend != nil {
+		arguments = append(arguments, backend.BuildArgs(opts)...)
+	}
 	return arguments
 }
 
 // postAnalysis post-analysis stage: wait for FUS stats to upload
 func postAnalysis(opts *QodanaOptions) {
 	syncIdeaCache(opts.ProjectDir, opts.CacheDir, true)
+	waitForStatisticsUploaders()
+}
+
+// waitForStatisticsUploaders blocks until no statistics-uploader process is
+// running, or up to 600 seconds. A multi-product run shares this single
+// wait across every product's uploader instead of calling it once per
+// product, so it waits for all of them rather than just the first to finish.
+func waitForStatisticsUploaders() {
 	for i := 1; i <= 600; i++ {
 		if findProcess("statistics-uploader") {
 			time.Sleep(time.Second)
@@ -126,64 +140,35 @@ var ( // base script name
 	goLand   = "goland"
 )
 
-var supportedIdes = [...]string{
-	idea,
-	phpStorm,
-	webStorm,
-	rider,
-	pyCharm,
-	rubyMine,
-	goLand,
-}
-
+// toQodanaCode maps an IDE's base product-info.json productCode (e.g. "IC",
+// "PY") to the Qodana product code for it, by asking each registered
+// IdeBackend's CodeFromBaseProduct in turn. A custom backend (e.g. a
+// CLion/RustRover preview) registered via RegisterBackend supplies its own
+// mapping this way instead of silently falling through to "QD".
 func toQodanaCode(baseProduct string) string {
-	switch baseProduct {
-	case "IC":
-		return QDJVMC
-	case "PC":
-		return QDPYC
-	case "IU":
-		return QDJVM
-	case "PS":
-		return QDPHP
-	case "WS":
-		return QDJS
-	case "RD":
-		return QDNET
-	case "PY":
-		return QDPY
-	case "GO":
-		return QDGO
-	default:
-		return "QD"
+	for _, name := range ideBackendsOrder {
+		if code, ok := ideBackends[name].CodeFromBaseProduct(baseProduct); ok {
+			return code
+		}
 	}
+	return "QD"
 }
 
+// scriptToProductCode dispatches to the registered IdeBackend's Code,
+// falling back to "QD" for an unregistered script name.
 func scriptToProductCode(scriptName string) string {
-	switch scriptName {
-	case idea:
-		return "QDJVM"
-	case phpStorm:
-		return "QDPHP"
-	case webStorm:
-		return "QDJS"
-	case rider:
-		return "QDNET"
-	case pyCharm:
-		return "QDPY"
-	case rubyMine:
-		return "QDRUBY"
-	case goLand:
-		return "QDGO"
-	default:
-		return "QD"
+	if backend := getBackend(scriptName); backend != nil {
+		return backend.Code()
 	}
+	return "QD"
 }
 
+// findIde returns the script name of the first registered IdeBackend whose
+// IDE is installed under dir, trying backends in registration order.
 func findIde(dir string) string {
-	for _, element := range supportedIdes {
-		if _, err := os.Stat(filepath.Join(dir, fmt.Sprintf("%s%s", element, getScriptSuffix()))); err == nil {
-			return element
+	for _, name := range ideBackendsOrder {
+		if ideBackends[name].Detect(dir) {
+			return name
 		}
 	}
 	return ""
@@ -224,15 +209,36 @@ func readAppInfoXml(ideDir string) appInfo {
 }
 
 func prepareLocalIdeSettings(opts *QodanaOptions) {
-	guessProduct(opts)
 	ExtractQodanaEnvironment()
+	prepareProduct(opts)
+}
+
+// prepareProduct resolves opts into the package-level Prod (via
+// guessProduct) and prepares that product's license, directories, IDE
+// config and plugins. It's a var (like runProductCmd) so a multi-product
+// test can stub it out instead of exercising guessProduct/
+// setupLicenseManager/installPlugins for real; production always points it
+// at prepareProductIdeSettings.
+var prepareProduct = prepareProductIdeSettings
+
+// prepareProductIdeSettings does the resolution/setup work shared by the
+// single-product path (prepareLocalIdeSettings) and a multi-product run's
+// per-product dispatch (runProduct, via resolveProductArgs): it guesses and
+// sets the package-level Prod for opts, then prepares that product's
+// license, directories, IDE config and plugins so the script built from the
+// now-resolved Prod actually matches opts.Ide.
+func prepareProductIdeSettings(opts *QodanaOptions) {
+	guessProduct(opts)
 	token := opts.ValidateToken(false)
-	setupLicense(token)
+	setupLicenseManager(token)
 	prepareDirectories(
 		opts.CacheDir,
 		opts.logDirPath(),
 		opts.confDirPath(),
 	)
+	if backend := getBackend(Prod.BaseScriptName); backend != nil {
+		backend.PrepareDirectories(opts)
+	}
 	Config = GetQodanaYaml(opts.ProjectDir)
 	writeAppInfo(opts.appInfoXmlPath(Prod.ideBin()))
 	writeProperties(opts)
@@ -243,9 +249,12 @@ func prepareLocalIdeSettings(opts *QodanaOptions) {
 	}
 
 	bootstrap(Config.Bootstrap, opts.ProjectDir)
-	installPlugins(Config.Plugins)
+	installPlugins(Config.Plugins, opts)
 }
 
+// prepareDirectories creates the directories and files common to every
+// IdeBackend; backend-specific caches (Rider's NuGet, IDEA's Gradle/Maven/
+// Android) are set up separately by that backend's PrepareDirectories.
 func prepareDirectories(cacheDir string, logDir string, confDir string) {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
@@ -258,26 +267,6 @@ func prepareDirectories(cacheDir string, logDir string, confDir string) {
 		confDir,
 		userPrefsDir,
 	}
-	if isDocker() {
-		if Prod.BaseScriptName == rider {
-			nugetDir := filepath.Join(cacheDir, nuget)
-			if err := os.Setenv("NUGET_PACKAGES", nugetDir); err != nil {
-				log.Fatal(err)
-			}
-			directories = append(
-				directories,
-				nugetDir,
-			)
-		} else if Prod.BaseScriptName == idea {
-			directories = append(
-				directories,
-				filepath.Join(cacheDir, m2),
-			)
-			if err = os.Setenv("GRADLE_USER_HOME", filepath.Join(cacheDir, "gradle")); err != nil {
-				log.Fatal(err)
-			}
-		}
-	}
 	for _, dir := range directories {
 		if _, err := os.Stat(dir); os.IsNotExist(err) {
 			if err := os.MkdirAll(dir, 0o755); err != nil {
@@ -299,34 +288,59 @@ func prepareDirectories(cacheDir string, logDir string, confDir string) {
 	runtime.GOOS != "darwin" && runtime.GOOS != "windows" {
 		writeFileIfNew(filepath.Join(ideaOptions, "security.xml"), securityXml)
 	}
+}
 
-	if Prod.BaseScriptName == idea {
-		mavenRootDir := filepath.Join(homeDir, ".m2")
-		if _, err = os.Stat(mavenRootDir); os.IsNotExist(err) {
-			if err = os.MkdirAll(mavenRootDir, 0o755); err != nil {
-				log.Fatal(err)
+// installPlugins resolves every plugin in qodana.yaml through the
+// content-addressable pluginCache and links the verified artifact into the
+// IDE's plugins directory, instead of re-downloading through
+// `Prod.IdeScript installPlugins` on every run. Plugins without a pinned
+// Version fall back to the legacy installer, since there's nothing to
+// address them by in the cache. A plugin pinned only by id/version (no
+// Sha256 in qodana.yaml) is resolved against qodana.lock.yaml first, so a
+// repeat run still cache-hits instead of re-downloading from the
+// marketplace.
+func installPlugins(plugins []Plugin, opts *QodanaOptions) {
+	if len(plugins) == 0 {
+		return
+	}
+
+	cache := newPluginCache(opts.CacheDir)
+	pluginsDir := filepath.Join(opts.confDirPath(), "plugins")
+	lockPath := filepath.Join(opts.ProjectDir, "qodana.lock.yaml")
+	lockedDigests, err := readPluginLockFile(lockPath)
+	if err != nil {
+		log.Printf("Failed to read %s: %v", lockPath, err)
+	}
+	var resolved []resolvedPlugin
+
+	for _, plugin := range plugins {
+		if plugin.Version == "" {
+			log.Printf("Installing plugin %s", plugin.Id)
+			if res := RunCmd("", quoteForWindows(Prod.IdeScript), "installPlugins", plugin.Id); res > 0 {
+				os.Exit(res)
 			}
+			continue
 		}
-		writeFileIfNew(filepath.Join(mavenRootDir, "settings.xml"), mavenSettingsXml)
-		writeFileIfNew(filepath.Join(ideaOptions, "path.macros.xml"), mavenPathMacroxXml)
 
-		androidSdk := os.Getenv(androidSdkRoot)
-		if androidSdk != "" && isDocker() {
-			writeFileIfNew(filepath.Join(ideaOptions, "project.default.xml"), androidProjectDefaultXml(androidSdk))
-			corettoSdk := os.Getenv(qodanaCorettoSdk)
-			if corettoSdk != "" {
-				writeFileIfNew(filepath.Join(ideaOptions, "jdk.table.xml"), jdkTableXml(corettoSdk))
-			}
+		if plugin.Sha256 == "" {
+			plugin.Sha256 = lockedDigests[plugin.Id+"@"+plugin.Version]
 		}
+
+		log.Printf("Resolving plugin %s@%s", plugin.Id, plugin.Version)
+		blobPath, digest, err := cache.ensure(plugin)
+		if err != nil {
+			log.Fatalf("Failed to install plugin %s@%s: %v", plugin.Id, plugin.Version, err)
+		}
+		if err = installFromCache(blobPath, pluginsDir, plugin.Id); err != nil {
+			log.Fatalf("Failed to install plugin %s@%s: %v", plugin.Id, plugin.Version, err)
+		}
+		resolved = append(resolved, resolvedPlugin{Id: plugin.Id, Version: plugin.Version, Sha256: digest})
 	}
-}
 
-// installPlugins runs plugin installer for every plugin id in qodana.yaml.
-func installPlugins(plugins []Plugin) {
-	for _, plugin := range plugins {
-		log.Printf("Installing plugin %s", plugin.Id)
-		if res := RunCmd("", quoteForWindows(Prod.IdeScript), "installPlugins", plugin.Id); res > 0 {
-			os.Exit(res)
+	if len(resolved) > 0 {
+		lockPath := filepath.Join(opts.ProjectDir, "qodana.lock.yaml")
+		if err := writePluginLockFile(lockPath, resolved); err != nil {
+			log.Printf("Failed to write %s: %v", lockPath, err)
 		}
 	}
 }
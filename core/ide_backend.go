@@ -0,0 +1,212 @@
+/*
+ * Copyright 2021-2023 JetBrains s.r.o.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// IdeBackend is the contract a JetBrains IDE (or a third-party `--linter`
+// image) implements to plug into runQodanaLocal. It replaces the fixed
+// supportedIdes/scriptToProductCode/findIde switches with a registry so
+// backend-specific quirks (Rider's NuGet, IDEA's Gradle/Maven/Android) live
+// next to the backend they belong to, and so a custom backend (e.g. a
+// CLion/RustRover preview, or a third-party linter) can be registered
+// without touching this package.
+type IdeBackend interface {
+	// Code is the Qodana product code this backend runs as, e.g. "QDJVM".
+	Code() string
+	// ScriptName is the base name of the IDE's inspect script, e.g. "idea".
+	ScriptName() string
+	// Detect reports whether this backend's IDE is installed under dir.
+	Detect(dir string) bool
+	// ProductInfo parses the IDE's product-info.json under ideDir.
+	ProductInfo(ideDir string) map[string]interface{}
+	// PrepareDirectories sets up any backend-specific caches/env vars
+	// (e.g. NUGET_PACKAGES, GRADLE_USER_HOME) before analysis starts.
+	PrepareDirectories(opts *QodanaOptions)
+	// BuildArgs returns extra `inspect qodana` CLI arguments specific to
+	// this backend, appended after the common ones in getIdeArgs.
+	BuildArgs(opts *QodanaOptions) []string
+	// CodeFromBaseProduct maps one of this backend's own base-IDE product
+	// abbreviations (read from product-info.json's productCode field, e.g.
+	// "IC"/"IU") to the Qodana product code toQodanaCode should report for
+	// it. ok is false when baseProduct doesn't belong to this backend at
+	// all, so toQodanaCode can keep trying other registered backends.
+	CodeFromBaseProduct(baseProduct string) (code string, ok bool)
+}
+
+// baseIdeBackend implements the shared, script-name-driven parts of
+// IdeBackend; concrete backends embed it and only override what differs.
+type baseIdeBackend struct {
+	scriptName  string
+	productCode string
+
+	// baseProductCode is the product-info.json base code this backend maps
+	// 1:1 to productCode, e.g. "WS" for WebStorm. Left empty for backends
+	// with no editions split by product-info.json (legacy behavior: such a
+	// backend is simply never matched by CodeFromBaseProduct) or that
+	// override CodeFromBaseProduct themselves (idea, pyCharm).
+	baseProductCode string
+}
+
+func (b baseIdeBackend) Code() string       { return b.productCode }
+func (b baseIdeBackend) ScriptName() string { return b.scriptName }
+
+func (b baseIdeBackend) CodeFromBaseProduct(baseProduct string) (string, bool) {
+	if b.baseProductCode == "" || baseProduct != b.baseProductCode {
+		return "", false
+	}
+	return b.productCode, true
+}
+
+func (b baseIdeBackend) Detect(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, fmt.Sprintf("%s%s", b.scriptName, getScriptSuffix())))
+	return err == nil
+}
+
+func (b baseIdeBackend) ProductInfo(ideDir string) map[string]interface{} {
+	return readIdeProductInfo(ideDir)
+}
+
+func (b baseIdeBackend) PrepareDirectories(_ *QodanaOptions) {}
+
+func (b baseIdeBackend) BuildArgs(_ *QodanaOptions) []string { return nil }
+
+var (
+	ideBackends      = map[string]IdeBackend{}
+	ideBackendsOrder []string
+)
+
+// RegisterBackend adds b to the registry, keyed by its ScriptName. Backends
+// are tried in registration order by findIde, so callers that want to
+// register a custom backend (CLion/RustRover preview, a third-party
+// `--linter` image, ...) should do so from an init() that runs after this
+// package's.
+func RegisterBackend(b IdeBackend) {
+	name := b.ScriptName()
+	if _, exists := ideBackends[name]; !exists {
+		ideBackendsOrder = append(ideBackendsOrder, name)
+	}
+	ideBackends[name] = b
+}
+
+// getBackend looks up a previously registered backend by script name.
+func getBackend(scriptName string) IdeBackend {
+	return ideBackends[scriptName]
+}
+
+type ideaBackend struct{ baseIdeBackend }
+type phpStormBackend struct{ baseIdeBackend }
+type webStormBackend struct{ baseIdeBackend }
+type riderBackend struct{ baseIdeBackend }
+type pyCharmBackend struct{ baseIdeBackend }
+type rubyMineBackend struct{ baseIdeBackend }
+type goLandBackend struct{ baseIdeBackend }
+
+func init() {
+	RegisterBackend(ideaBackend{baseIdeBackend{scriptName: idea, productCode: QDJVM}})
+	RegisterBackend(phpStormBackend{baseIdeBackend{scriptName: phpStorm, productCode: QDPHP, baseProductCode: "PS"}})
+	RegisterBackend(webStormBackend{baseIdeBackend{scriptName: webStorm, productCode: QDJS, baseProductCode: "WS"}})
+	RegisterBackend(riderBackend{baseIdeBackend{scriptName: rider, productCode: QDNET, baseProductCode: "RD"}})
+	RegisterBackend(pyCharmBackend{baseIdeBackend{scriptName: pyCharm, productCode: QDPY}})
+	RegisterBackend(rubyMineBackend{baseIdeBackend{scriptName: rubyMine, productCode: "QDRUBY"}})
+	RegisterBackend(goLandBackend{baseIdeBackend{scriptName: goLand, productCode: QDGO, baseProductCode: "GO"}})
+}
+
+// CodeFromBaseProduct splits IntelliJ's community ("IC") and ultimate
+// ("IU") editions into distinct Qodana codes — the one mapping in
+// toQodanaCode that isn't a straight 1:1 with productCode.
+func (b ideaBackend) CodeFromBaseProduct(baseProduct string) (string, bool) {
+	switch baseProduct {
+	case "IC":
+		return QDJVMC, true
+	case "IU":
+		return b.productCode, true
+	default:
+		return "", false
+	}
+}
+
+// CodeFromBaseProduct splits PyCharm's community ("PC") and professional
+// ("PY") editions into distinct Qodana codes.
+func (b pyCharmBackend) CodeFromBaseProduct(baseProduct string) (string, bool) {
+	switch baseProduct {
+	case "PC":
+		return QDPYC, true
+	case "PY":
+		return b.productCode, true
+	default:
+		return "", false
+	}
+}
+
+// PrepareDirectories sets up IDEA's Gradle/Maven/Android caches, which used
+// to live in a Prod.BaseScriptName == idea branch inside prepareDirectories.
+func (ideaBackend) PrepareDirectories(opts *QodanaOptions) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ideaOptions := filepath.Join(opts.confDirPath(), "options")
+
+	if isDocker() {
+		if err = os.MkdirAll(filepath.Join(opts.CacheDir, m2), 0o755); err != nil {
+			log.Fatal(err)
+		}
+		if err = os.Setenv("GRADLE_USER_HOME", filepath.Join(opts.CacheDir, "gradle")); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	mavenRootDir := filepath.Join(homeDir, ".m2")
+	if _, err = os.Stat(mavenRootDir); os.IsNotExist(err) {
+		if err = os.MkdirAll(mavenRootDir, 0o755); err != nil {
+			log.Fatal(err)
+		}
+	}
+	writeFileIfNew(filepath.Join(mavenRootDir, "settings.xml"), mavenSettingsXml)
+	writeFileIfNew(filepath.Join(ideaOptions, "path.macros.xml"), mavenPathMacroxXml)
+
+	androidSdk := os.Getenv(androidSdkRoot)
+	if androidSdk != "" && isDocker() {
+		writeFileIfNew(filepath.Join(ideaOptions, "project.default.xml"), androidProjectDefaultXml(androidSdk))
+		corettoSdk := os.Getenv(qodanaCorettoSdk)
+		if corettoSdk != "" {
+			writeFileIfNew(filepath.Join(ideaOptions, "jdk.table.xml"), jdkTableXml(corettoSdk))
+		}
+	}
+}
+
+// PrepareDirectories points NuGet at the cache dir, which used to live in a
+// Prod.BaseScriptName == rider branch inside prepareDirectories.
+func (riderBackend) PrepareDirectories(opts *QodanaOptions) {
+	if !isDocker() {
+		return
+	}
+	nugetDir := filepath.Join(opts.CacheDir, nuget)
+	if err := os.Setenv("NUGET_PACKAGES", nugetDir); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(nugetDir, 0o755); err != nil {
+		log.Fatal(err)
+	}
+}
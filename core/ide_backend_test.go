@@ -0,0 +1,93 @@
+/*
+ * Copyright 2021-2023 JetBrains s.r.o.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegisteredBackendsRoundTrip(t *testing.T) {
+	if len(ideBackendsOrder) != 7 {
+		t.Fatalf("expected 7 registered backends, got %d", len(ideBackendsOrder))
+	}
+	for _, name := range ideBackendsOrder {
+		t.Run(name, func(t *testing.T) {
+			backend := getBackend(name)
+			if backend == nil {
+				t.Fatalf("backend %s not found in registry", name)
+			}
+			if backend.ScriptName() != name {
+				t.Errorf("expected ScriptName '%s' got '%s'", name, backend.ScriptName())
+			}
+			if backend.Code() == "" {
+				t.Error("expected a non-empty product Code")
+			}
+
+			dir := t.TempDir()
+			productInfoPath := filepath.Join(dir, "product-info.json")
+			if err := os.WriteFile(productInfoPath, []byte(`{"productCode":"TEST"}`), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			info := backend.ProductInfo(dir)
+			if info["productCode"] != "TEST" {
+				t.Errorf("expected ProductInfo to read product-info.json, got %v", info)
+			}
+
+			// BuildArgs must not panic on a zero-value QodanaOptions; reaching
+			// the line below is itself the assertion.
+			_ = backend.BuildArgs(&QodanaOptions{})
+		})
+	}
+}
+
+func TestToQodanaCodeUsesBackendRegistry(t *testing.T) {
+	for _, testData := range []struct {
+		baseProduct string
+		want        string
+	}{
+		{"IC", QDJVMC},
+		{"IU", QDJVM},
+		{"PC", QDPYC},
+		{"PY", QDPY},
+		{"PS", QDPHP},
+		{"WS", QDJS},
+		{"RD", QDNET},
+		{"GO", QDGO},
+		{"unknown", "QD"},
+	} {
+		t.Run(testData.baseProduct, func(t *testing.T) {
+			if got := toQodanaCode(testData.baseProduct); got != testData.want {
+				t.Errorf("expected '%s' got '%s'", testData.want, got)
+			}
+		})
+	}
+}
+
+func TestFindIdeUsesRegistrationOrder(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range ideBackendsOrder {
+		scriptPath := filepath.Join(dir, name+getScriptSuffix())
+		if err := os.WriteFile(scriptPath, []byte(""), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := findIde(dir); got != ideBackendsOrder[0] {
+		t.Errorf("expected findIde to return the first registered backend '%s', got '%s'", ideBackendsOrder[0], got)
+	}
+}
@@ -0,0 +1,284 @@
+/*
+ * Copyright 2021-2023 JetBrains s.r.o.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	qodanaLicenseRefreshIntervalEnv = "QODANA_LICENSE_REFRESH_INTERVAL"
+	defaultLicenseRefreshInterval   = 24 * time.Hour
+	licenseExpirationDateFormat     = "2006-01-02"
+)
+
+// licenseExpiryWarningThresholds are the days-to-expiration marks at which
+// expiryWarningWatcher logs a WARN. LicenseManager calls OnExpiringSoon on
+// every refresh that finds the license within the first (largest) mark.
+var licenseExpiryWarningThresholds = []int{14, 7, 1}
+
+// License is the parsed shape of a qodanaLicenseEndpoint response, shared
+// between the one-shot setupLicense path and the LicenseManager poller.
+type License struct {
+	Id             string `json:"licenseId"`
+	Key            string `json:"licenseKey"`
+	ExpirationDate string `json:"expirationDate"`
+	Plan           string `json:"licensePlan"`
+}
+
+// expiresAt parses ExpirationDate, returning an error for an empty or
+// malformed date so callers can tell "no date" from "already expired".
+func (l License) expiresAt() (time.Time, error) {
+	return time.Parse(licenseExpirationDateFormat, l.ExpirationDate)
+}
+
+func parseLicense(data []byte) (License, error) {
+	var license License
+	if err := json.Unmarshal(data, &license); err != nil {
+		return License{}, fmt.Errorf("invalid license data: %w", err)
+	}
+	return license, nil
+}
+
+// Watcher is notified of license lifecycle events observed by a LicenseManager.
+type Watcher interface {
+	OnNewLicense(license License)
+	OnExpiringSoon(license License, days int)
+	OnStopped()
+}
+
+// LicenseManager polls qodanaLicenseEndpoint on an interval, diffs the
+// result against the last seen license and fans out the changes to its
+// Watchers, following the same poll-diff-notify shape as Elastic beats'
+// licenser. It replaces the old fire-once setupLicense call for long-running
+// processes (e.g. `qodana scan --watch` or an IDE kept warm in a container).
+type LicenseManager struct {
+	endpoint string
+	token    string
+	interval time.Duration
+
+	mu       sync.Mutex
+	watchers []Watcher
+	current  License
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewLicenseManager builds a manager that will poll endpoint for token's
+// license once Start is called. The refresh interval defaults to 24h and
+// can be overridden with QODANA_LICENSE_REFRESH_INTERVAL (seconds).
+func NewLicenseManager(endpoint string, token string) *LicenseManager {
+	return &LicenseManager{
+		endpoint: endpoint,
+		token:    token,
+		interval: getLicenseRefreshInterval(),
+	}
+}
+
+// AddWatcher registers w to receive every subsequent poll's events.
+func (m *LicenseManager) AddWatcher(w Watcher) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.watchers = append(m.watchers, w)
+}
+
+// Start runs an initial refresh synchronously and then continues polling in
+// a background goroutine until ctx is cancelled or Stop is called.
+func (m *LicenseManager) Start(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	m.cancel = cancel
+	m.done = make(chan struct{})
+
+	m.refresh()
+
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				m.notifyStopped()
+				return
+			case <-ticker.C:
+				m.refresh()
+			}
+		}
+	}()
+}
+
+// Stop cancels the poller and blocks until its goroutine has exited.
+func (m *LicenseManager) Stop() {
+	if m.cancel == nil {
+		return
+	}
+	m.cancel()
+	<-m.done
+}
+
+func (m *LicenseManager) refresh() {
+	data, err := requestLicenseData(m.endpoint, m.token)
+	if err != nil {
+		log.Warnf("License refresh failed: %v", err)
+		return
+	}
+	license, err := parseLicense(data)
+	if err != nil {
+		log.Warnf("License refresh failed: %v", err)
+		return
+	}
+
+	m.mu.Lock()
+	changed := license != m.current
+	m.current = license
+	m.mu.Unlock()
+
+	if changed {
+		m.notifyNewLicense(license)
+	}
+
+	expiresAt, err := license.expiresAt()
+	if err != nil {
+		return
+	}
+	if days := int(time.Until(expiresAt).Hours() / 24); days <= licenseExpiryWarningThresholds[0] {
+		m.notifyExpiringSoon(license, days)
+	}
+}
+
+func (m *LicenseManager) notifyNewLicense(license License) {
+	for _, w := range m.watchers {
+		w.OnNewLicense(license)
+	}
+}
+
+func (m *LicenseManager) notifyExpiringSoon(license License, days int) {
+	for _, w := range m.watchers {
+		w.OnExpiringSoon(license, days)
+	}
+}
+
+func (m *LicenseManager) notifyStopped() {
+	for _, w := range m.watchers {
+		w.OnStopped()
+	}
+}
+
+func getLicenseRefreshInterval() time.Duration {
+	if v := os.Getenv(qodanaLicenseRefreshIntervalEnv); v != "" {
+		if seconds, err := strconv.Atoi(v); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return defaultLicenseRefreshInterval
+}
+
+// setupLicenseManager replaces the old fire-once setupLicense call for
+// long-running processes: when QODANA_LICENSE_FILE is configured it loads
+// and verifies the license entirely offline, skipping the network poller
+// outright; otherwise it starts a LicenseManager against
+// qodanaLicenseEndpoint (when one is configured) with the env-var watcher
+// and the expiry-warning watcher registered, and refuses to proceed if the
+// license has already expired.
+func setupLicenseManager(token string) {
+	if setupLicenseOffline(token) {
+		return
+	}
+
+	endpoint := os.Getenv(qodanaLicenseEndpoint)
+	if endpoint == "" {
+		return
+	}
+
+	manager := NewLicenseManager(endpoint, token)
+	manager.AddWatcher(envVarLicenseWatcher{})
+	expiry := newExpiryWarningWatcher()
+	manager.AddWatcher(expiry)
+	manager.Start(context.Background())
+
+	if expiry.Expired() {
+		log.Fatal("Qodana license has expired, refusing to start analysis")
+	}
+}
+
+// envVarLicenseWatcher keeps QODANA_LICENSE in sync with the latest polled
+// license. It is registered as the first watcher on every LicenseManager so
+// the rest of the codebase keeps reading the license out of the env var, the
+// same contract setupLicense established for the one-shot path.
+type envVarLicenseWatcher struct{}
+
+func (envVarLicenseWatcher) OnNewLicense(license License) {
+	if err := os.Setenv(qodanaLicense, license.Key); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (envVarLicenseWatcher) OnExpiringSoon(License, int) {}
+
+func (envVarLicenseWatcher) OnStopped() {}
+
+// expiryWarningWatcher logs a single WARN per threshold in
+// licenseExpiryWarningThresholds as a license approaches its expiration
+// date, and flags the license as expired once its expiration date has
+// passed so long-running callers can refuse to start new analyses.
+type expiryWarningWatcher struct {
+	mu      sync.Mutex
+	warned  map[int]bool
+	expired bool
+}
+
+func newExpiryWarningWatcher() *expiryWarningWatcher {
+	return &expiryWarningWatcher{warned: make(map[int]bool)}
+}
+
+func (w *expiryWarningWatcher) OnNewLicense(License) {}
+
+func (w *expiryWarningWatcher) OnExpiringSoon(license License, days int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if days < 0 {
+		w.expired = true
+		log.Errorf("Qodana license %s expired %d day(s) ago", license.Id, -days)
+		return
+	}
+	for _, threshold := range licenseExpiryWarningThresholds {
+		if days == threshold && !w.warned[threshold] {
+			w.warned[threshold] = true
+			log.Warnf("Qodana license %s expires in %d day(s)", license.Id, days)
+		}
+	}
+}
+
+func (w *expiryWarningWatcher) OnStopped() {}
+
+// Expired reports whether the most recent refresh observed a license past
+// its expiration date; runQodanaLocal-style entry points can consult it
+// before starting a new analysis.
+func (w *expiryWarningWatcher) Expired() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.expired
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2021-2023 JetBrains s.r.o.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingWatcher struct {
+	mu       sync.Mutex
+	licenses []License
+	stopped  bool
+}
+
+func (r *recordingWatcher) OnNewLicense(license License) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.licenses = append(r.licenses, license)
+}
+
+func (r *recordingWatcher) OnExpiringSoon(License, int) {}
+
+func (r *recordingWatcher) OnStopped() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopped = true
+}
+
+func (r *recordingWatcher) seen() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.licenses)
+}
+
+func TestLicenseManagerNotifiesOnChange(t *testing.T) {
+	licenseId := "VA5HGQWQH6"
+	expiration := time.Now().Add(30 * 24 * time.Hour).Format(licenseExpirationDateFormat)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(
+			w,
+			`{"licenseId":"%s","licenseKey":"key","expirationDate":"%s","licensePlan":"ULTIMATE"}`,
+			licenseId, expiration,
+		)
+	}))
+	defer svr.Close()
+
+	manager := NewLicenseManager(svr.URL, "token")
+	watcher := &recordingWatcher{}
+	manager.AddWatcher(envVarLicenseWatcher{})
+	manager.AddWatcher(watcher)
+
+	manager.Start(context.Background())
+	defer manager.Stop()
+
+	if watcher.seen() != 1 {
+		t.Fatalf("expected 1 license notification after initial refresh, got %d", watcher.seen())
+	}
+	if got := os.Getenv(qodanaLicense); got != "key" {
+		t.Errorf("expected envVarLicenseWatcher to set %s to 'key', got '%s'", qodanaLicense, got)
+	}
+	os.Unsetenv(qodanaLicense)
+
+	manager.refresh()
+	if watcher.seen() != 1 {
+		t.Errorf("expected unchanged license to not re-notify, got %d notifications", watcher.seen())
+	}
+}
+
+func TestLicenseManagerStop(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `{"licenseId":"id","licenseKey":"key","expirationDate":"2099-01-01","licensePlan":"ULTIMATE"}`)
+	}))
+	defer svr.Close()
+
+	manager := NewLicenseManager(svr.URL, "token")
+	watcher := &recordingWatcher{}
+	manager.AddWatcher(watcher)
+	manager.Start(context.Background())
+	manager.Stop()
+
+	if !watcher.stopped {
+		t.Error("expected OnStopped to be called after Stop")
+	}
+}
+
+func TestExpiryWarningWatcher(t *testing.T) {
+	w := newExpiryWarningWatcher()
+	license := License{Id: "id", ExpirationDate: "2099-01-01"}
+
+	w.OnExpiringSoon(license, 7)
+	if w.Expired() {
+		t.Error("license 7 days out should not be considered expired")
+	}
+
+	w.OnExpiringSoon(license, -1)
+	if !w.Expired() {
+		t.Error("license with negative days-to-expiry should be considered expired")
+	}
+}
+
+func TestSetupLicenseManagerWiresEnvVarWatcher(t *testing.T) {
+	expiration := time.Now().Add(30 * 24 * time.Hour).Format(licenseExpirationDateFormat)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"licenseId":"id","licenseKey":"key","expirationDate":"%s","licensePlan":"ULTIMATE"}`, expiration)
+	}))
+	defer svr.Close()
+
+	os.Setenv(qodanaLicenseEndpoint, svr.URL)
+	defer os.Unsetenv(qodanaLicenseEndpoint)
+	defer os.Unsetenv(qodanaLicense)
+
+	setupLicenseManager("token")
+
+	if got := os.Getenv(qodanaLicense); got != "key" {
+		t.Errorf("expected setupLicenseManager to populate %s via the env-var watcher, got '%s'", qodanaLicense, got)
+	}
+}
+
+func TestSetupLicenseManagerNoopWithoutEndpoint(t *testing.T) {
+	os.Unsetenv(qodanaLicenseEndpoint)
+	os.Unsetenv(qodanaLicense)
+	setupLicenseManager("token")
+	if got := os.Getenv(qodanaLicense); got != "" {
+		t.Errorf("expected no endpoint configured to leave %s unset, got '%s'", qodanaLicense, got)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright 2021-2023 JetBrains s.r.o.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	qodanaLicenseFile   = "QODANA_LICENSE_FILE"
+	qodanaLicensePubKey = "QODANA_LICENSE_PUBKEY"
+)
+
+// jetBrainsLicensePublicKey is the base64-encoded ed25519 public key used to
+// verify offline license files when QODANA_LICENSE_PUBKEY isn't set.
+// Release builds inject the real JetBrains key via -ldflags; it is
+// intentionally empty here so a missing key fails closed instead of
+// silently trusting unsigned input.
+var jetBrainsLicensePublicKey string
+
+// licenseFatal is log.Fatalf, called by setupLicenseOffline to refuse to
+// start analysis on an unreadable, malformed, unsigned or expired offline
+// license, mirroring setupLicenseManager's hard refusal on an expired
+// online license. It's a var so tests can stub it to observe the refusal
+// instead of exiting the test binary.
+var licenseFatal = log.Fatalf
+
+// offlineLicense is the on-disk shape of a QODANA_LICENSE_FILE: a License
+// plus a detached signature over its canonicalized payload.
+type offlineLicense struct {
+	License
+	Signature string `json:"signature"`
+}
+
+// setupLicenseOffline is consulted by setupLicenseManager before it falls
+// back to the qodanaLicenseEndpoint poller: when QODANA_LICENSE_FILE is set, it
+// verifies and loads the license entirely from disk and reports true so the
+// caller skips the network path. It returns false (with nothing applied)
+// when no offline license file is configured. Any failure to read, parse,
+// verify or validate the license (including an already-expired one) calls
+// licenseFatal to refuse to start analysis, rather than silently continuing
+// unlicensed.
+func setupLicenseOffline(token string) bool {
+	path := os.Getenv(qodanaLicenseFile)
+	if path == "" {
+		return false
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		licenseFatal("Failed to read offline license file: %v", err)
+		return true
+	}
+
+	var offline offlineLicense
+	if err = json.Unmarshal(data, &offline); err != nil {
+		licenseFatal("Invalid offline license file: %v", err)
+		return true
+	}
+
+	payload, err := json.Marshal(offline.License)
+	if err != nil {
+		licenseFatal("Failed to canonicalize offline license payload: %v", err)
+		return true
+	}
+
+	pubKey, err := licensePublicKey()
+	if err != nil {
+		licenseFatal("Failed to load license public key: %v", err)
+		return true
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(offline.Signature)
+	if err != nil || !ed25519.Verify(pubKey, payload, signature) {
+		licenseFatal("Offline license signature verification failed")
+		return true
+	}
+
+	expiresAt, err := offline.expiresAt()
+	if err != nil {
+		licenseFatal("Invalid offline license expiration date: %v", err)
+		return true
+	}
+	daysLeft := int(time.Until(expiresAt).Hours() / 24)
+	if daysLeft < 0 {
+		licenseFatal("Offline license %s expired %d day(s) ago, refusing to start analysis", offline.Id, -daysLeft)
+		return true
+	}
+	if daysLeft <= 14 {
+		log.Warnf("Offline license %s expires in %d day(s)", offline.Id, daysLeft)
+	}
+
+	if err = os.Setenv(qodanaLicense, offline.Key); err != nil {
+		log.Fatal(err)
+	}
+	setupLicenseToken(&QodanaOptions{})
+	return true
+}
+
+func licensePublicKey() (ed25519.PublicKey, error) {
+	encoded := os.Getenv(qodanaLicensePubKey)
+	if encoded == "" {
+		encoded = jetBrainsLicensePublicKey
+	}
+	if encoded == "" {
+		return nil, fmt.Errorf("no license public key configured, set %s", qodanaLicensePubKey)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid license public key: %w", err)
+	}
+	if len(decoded) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("license public key has wrong size: got %d, want %d", len(decoded), ed25519.PublicKeySize)
+	}
+	return decoded, nil
+}
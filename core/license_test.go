@@ -17,10 +17,14 @@
 package core
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -291,3 +295,98 @@ func TestSetupLicense(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// stubLicenseFatal replaces licenseFatal with a counting no-op for the
+// duration of t, so a test can assert that an offline license failure
+// actually triggered a refusal instead of exiting the test binary.
+func stubLicenseFatal(t *testing.T) *int {
+	t.Helper()
+	calls := 0
+	original := licenseFatal
+	t.Cleanup(func() { licenseFatal = original })
+	licenseFatal = func(string, ...interface{}) { calls++ }
+	return &calls
+}
+
+func TestSetupLicenseOffline(t *testing.T) {
+	pubKey, privKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(qodanaLicensePubKey, base64.StdEncoding.EncodeToString(pubKey))
+	defer os.Unsetenv(qodanaLicensePubKey)
+
+	writeLicenseFile := func(t *testing.T, license License, corruptSignature bool) string {
+		payload, err := json.Marshal(license)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature := ed25519.Sign(privKey, payload)
+		if corruptSignature {
+			signature[0] ^= 0xFF
+		}
+		offline := offlineLicense{License: license, Signature: base64.StdEncoding.EncodeToString(signature)}
+		data, err := json.Marshal(offline)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), "license.json")
+		if err = os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	t.Run("valid license", func(t *testing.T) {
+		license := License{Id: "VA5HGQWQH6", Key: "VA5HGQWQH6", ExpirationDate: "2099-01-01", Plan: "ULTIMATE"}
+		os.Setenv(qodanaLicenseFile, writeLicenseFile(t, license, false))
+		defer os.Unsetenv(qodanaLicenseFile)
+		defer os.Unsetenv(qodanaLicense)
+
+		if !setupLicenseOffline("token") {
+			t.Fatal("expected setupLicenseOffline to handle a configured QODANA_LICENSE_FILE")
+		}
+		if got := os.Getenv(qodanaLicense); got != license.Key {
+			t.Errorf("expected %s to be '%s' got '%s'", qodanaLicense, license.Key, got)
+		}
+	})
+
+	t.Run("tampered signature", func(t *testing.T) {
+		license := License{Id: "VA5HGQWQH6", Key: "VA5HGQWQH6", ExpirationDate: "2099-01-01", Plan: "ULTIMATE"}
+		os.Setenv(qodanaLicenseFile, writeLicenseFile(t, license, true))
+		defer os.Unsetenv(qodanaLicenseFile)
+		defer os.Unsetenv(qodanaLicense)
+
+		fatalCalls := stubLicenseFatal(t)
+		setupLicenseOffline("token")
+		if got := os.Getenv(qodanaLicense); got != "" {
+			t.Errorf("expected tampered license to be rejected, but %s was set to '%s'", qodanaLicense, got)
+		}
+		if *fatalCalls != 1 {
+			t.Errorf("expected a tampered signature to refuse to start analysis, got %d refusal(s)", *fatalCalls)
+		}
+	})
+
+	t.Run("expired license", func(t *testing.T) {
+		license := License{Id: "VA5HGQWQH6", Key: "VA5HGQWQH6", ExpirationDate: "2020-01-01", Plan: "ULTIMATE"}
+		os.Setenv(qodanaLicenseFile, writeLicenseFile(t, license, false))
+		defer os.Unsetenv(qodanaLicenseFile)
+		defer os.Unsetenv(qodanaLicense)
+
+		fatalCalls := stubLicenseFatal(t)
+		setupLicenseOffline("token")
+		if got := os.Getenv(qodanaLicense); got != "" {
+			t.Errorf("expected expired license to be refused, but %s was set to '%s'", qodanaLicense, got)
+		}
+		if *fatalCalls != 1 {
+			t.Errorf("expected an expired license to refuse to start analysis, got %d refusal(s)", *fatalCalls)
+		}
+	})
+
+	t.Run("no file configured", func(t *testing.T) {
+		os.Unsetenv(qodanaLicenseFile)
+		if setupLicenseOffline("token") {
+			t.Error("expected setupLicenseOffline to report false when QODANA_LICENSE_FILE is unset")
+		}
+	})
+}
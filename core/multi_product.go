@@ -0,0 +1,219 @@
+/*
+ * Copyright 2021-2023 JetBrains s.r.o.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runProductCmd runs a single product's IDE inspection; it's a var (rather
+// than calling RunCmd directly) so tests can stub it out without shelling
+// out to a real IDE script.
+var runProductCmd = RunCmd
+
+// prodMu serializes resolution of the package-level Prod/Config globals
+// across concurrent runProduct goroutines. Prod is a single global slot:
+// without this lock, one product's guessProduct/installPlugins could run
+// while another goroutine reads Prod to build its own args, handing it the
+// wrong IDE script or plugin set.
+var prodMu sync.Mutex
+
+const qodanaProductsParallelismEnv = "QODANA_PRODUCTS_PARALLELISM"
+
+// getProductsParallelism bounds how many `--products` run at once, defaulting
+// to half the available CPUs so a polyglot run doesn't starve the machine.
+func getProductsParallelism() int {
+	if v := os.Getenv(qodanaProductsParallelismEnv); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	if n := runtime.NumCPU() / 2; n > 0 {
+		return n
+	}
+	return 1
+}
+
+// productResult is one product's outcome, collected by index so the SARIF
+// merge stays deterministic regardless of which goroutine finishes first.
+type productResult struct {
+	product    string
+	resultsDir string
+	exitCode   int
+}
+
+// runQodanaLocalMultiProduct orchestrates one goroutine per entry in
+// opts.Products, each with its own isolated ResultsDir/CacheDir (and
+// therefore confDir/logDir), bounded to getProductsParallelism() concurrent
+// IDE inspections. It merges every product's SARIF into a single
+// opts.ResultsDir/qodana.sarif.json and returns the max per-product exit
+// code, treating QodanaFailThresholdExitCode as non-fatal.
+func runQodanaLocalMultiProduct(opts *QodanaOptions) int {
+	products := opts.Products
+	log.Printf("Running %d products in parallel (max %d at a time): %v", len(products), getProductsParallelism(), products)
+
+	results := make([]productResult, len(products))
+	sem := make(chan struct{}, getProductsParallelism())
+	var wg sync.WaitGroup
+	for i, product := range products {
+		wg.Add(1)
+		go func(i int, product string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = runProduct(opts, product)
+		}(i, product)
+	}
+	wg.Wait()
+
+	resultDirs := make([]string, len(results))
+	for i, result := range results {
+		resultDirs[i] = result.resultsDir
+	}
+
+	sarifPath := filepath.Join(opts.ResultsDir, "qodana.sarif.json")
+	if err := mergeSarifResults(resultDirs, sarifPath); err != nil {
+		log.Errorf("Failed to merge SARIF results: %v", err)
+	}
+
+	waitForStatisticsUploaders()
+	return aggregateExitCodes(results)
+}
+
+// aggregateExitCodes reduces every product's exit code to one, the same way
+// a single-product run would: a QodanaFailThresholdExitCode by itself still
+// fails the build (matching runQodanaLocal, which never early-returns
+// success on it), but it's surfaced only if no product returned something
+// worse.
+func aggregateExitCodes(results []productResult) int {
+	maxExit := QodanaSuccessExitCode
+	sawFailThreshold := false
+	for _, result := range results {
+		if result.exitCode == QodanaFailThresholdExitCode {
+			sawFailThreshold = true
+			continue
+		}
+		if result.exitCode > maxExit {
+			maxExit = result.exitCode
+		}
+	}
+	if maxExit == QodanaSuccessExitCode && sawFailThreshold {
+		return QodanaFailThresholdExitCode
+	}
+	return maxExit
+}
+
+// runProduct runs a single product's IDE inspection in its own isolated
+// ResultsDir/CacheDir, mirroring the single-product path in runQodanaLocal
+// without the sequential postAnalysis statistics-uploader wait, which the
+// caller performs once for every product instead.
+func runProduct(parent *QodanaOptions, product string) productResult {
+	productOpts := *parent
+	productOpts.Products = nil
+	productOpts.Ide = product
+	productOpts.CacheDir = filepath.Join(parent.CacheDir, product)
+	productOpts.ResultsDir = filepath.Join(parent.ResultsDir, product)
+
+	if err := os.MkdirAll(productOpts.ResultsDir, 0o755); err != nil {
+		log.Errorf("Failed to create results directory for %s: %v", product, err)
+		return productResult{product: product, resultsDir: productOpts.ResultsDir, exitCode: 1}
+	}
+
+	args := resolveProductArgs(&productOpts)
+	exitCode := runProductCmd("", args...)
+
+	syncIdeaCache(productOpts.ProjectDir, productOpts.CacheDir, true)
+	if exitCode > QodanaSuccessExitCode && exitCode != QodanaFailThresholdExitCode {
+		return productResult{product: product, resultsDir: productOpts.ResultsDir, exitCode: exitCode}
+	}
+	if productOpts.SaveReport || productOpts.ShowReport {
+		saveReport(&productOpts)
+	}
+	if token := productOpts.ValidateToken(false); token != "" {
+		sendReport(&productOpts, token)
+	}
+
+	return productResult{product: product, resultsDir: productOpts.ResultsDir, exitCode: exitCode}
+}
+
+// resolveProductArgs resolves productOpts.Ide into the package-level Prod
+// (via prepareProduct, which runs that product's own license/plugins/
+// bootstrap prep) and builds its `inspect qodana` invocation. Resolution is
+// serialized by prodMu since it reads and mutates Prod/Config; only the args
+// slice is carried out of the lock, so the actual (slow) IDE invocation
+// still runs unlocked, in parallel with other products.
+func resolveProductArgs(productOpts *QodanaOptions) []string {
+	prodMu.Lock()
+	defer prodMu.Unlock()
+
+	prepareProduct(productOpts)
+
+	args := []string{quoteForWindows(Prod.IdeScript), "inspect", "qodana", "--stub-profile", quoteForWindows(productOpts.stabProfilePath())}
+	args = append(args, quoteForWindows(productOpts.ProjectDir), quoteForWindows(productOpts.ResultsDir))
+	args = append(args, getIdeArgs(productOpts)...)
+	return args
+}
+
+// sarifLog is the subset of the SARIF 2.1.0 shape mergeSarifResults needs:
+// enough to concatenate runs while preserving each product's
+// tool.driver.name discriminator.
+type sarifLog struct {
+	Schema  string            `json:"$schema,omitempty"`
+	Version string            `json:"version"`
+	Runs    []json.RawMessage `json:"runs"`
+}
+
+// mergeSarifResults concatenates the `runs` array of every product's
+// qodana.sarif.json, in resultsDirs order, into a single SARIF document at
+// outputPath. A product whose SARIF is missing (e.g. it failed before
+// producing one) is skipped rather than failing the whole merge.
+func mergeSarifResults(resultsDirs []string, outputPath string) error {
+	merged := sarifLog{Version: "2.1.0"}
+	for _, dir := range resultsDirs {
+		path := filepath.Join(dir, "qodana.sarif.json")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Warnf("Skipping missing SARIF at %s: %v", path, err)
+			continue
+		}
+		var doc sarifLog
+		if err = json.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("failed to parse SARIF from %s: %w", path, err)
+		}
+		if merged.Schema == "" {
+			merged.Schema = doc.Schema
+		}
+		merged.Runs = append(merged.Runs, doc.Runs...)
+	}
+
+	data, err := json.MarshalIndent(merged, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal merged SARIF: %w", err)
+	}
+	if err = os.MkdirAll(filepath.Dir(outputPath), 0o755); err != nil {
+		return fmt.Errorf("failed to create results directory: %w", err)
+	}
+	return os.WriteFile(outputPath, data, 0o644)
+}
@@ -0,0 +1,241 @@
+/*
+ * Copyright 2021-2023 JetBrains s.r.o.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func writeFakeSarif(t *testing.T, dir string, toolName string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	sarif := `{"$schema":"https://example.com/sarif-2.1.0.json","version":"2.1.0","runs":[{"tool":{"driver":{"name":"` + toolName + `"}}}]}`
+	if err := os.WriteFile(filepath.Join(dir, "qodana.sarif.json"), []byte(sarif), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeSarifResultsIsDeterministic(t *testing.T) {
+	base := t.TempDir()
+	jvmDir := filepath.Join(base, "QDJVM")
+	pyDir := filepath.Join(base, "QDPY")
+	writeFakeSarif(t, jvmDir, "QDJVM")
+	writeFakeSarif(t, pyDir, "QDPY")
+
+	outputPath := filepath.Join(base, "qodana.sarif.json")
+	if err := mergeSarifResults([]string{jvmDir, pyDir}, outputPath); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var merged sarifLog
+	if err = json.Unmarshal(data, &merged); err != nil {
+		t.Fatal(err)
+	}
+	if len(merged.Runs) != 2 {
+		t.Fatalf("expected 2 merged runs, got %d", len(merged.Runs))
+	}
+
+	var firstRun struct {
+		Tool struct {
+			Driver struct {
+				Name string `json:"name"`
+			} `json:"driver"`
+		} `json:"tool"`
+	}
+	if err = json.Unmarshal(merged.Runs[0], &firstRun); err != nil {
+		t.Fatal(err)
+	}
+	if firstRun.Tool.Driver.Name != "QDJVM" {
+		t.Errorf("expected the first run to come from QDJVM (resultsDirs order), got '%s'", firstRun.Tool.Driver.Name)
+	}
+}
+
+func TestMergeSarifResultsSkipsMissing(t *testing.T) {
+	base := t.TempDir()
+	jvmDir := filepath.Join(base, "QDJVM")
+	writeFakeSarif(t, jvmDir, "QDJVM")
+	missingDir := filepath.Join(base, "QDGO")
+
+	outputPath := filepath.Join(base, "qodana.sarif.json")
+	if err := mergeSarifResults([]string{jvmDir, missingDir}, outputPath); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var merged sarifLog
+	if err = json.Unmarshal(data, &merged); err != nil {
+		t.Fatal(err)
+	}
+	if len(merged.Runs) != 1 {
+		t.Errorf("expected the missing product's SARIF to be skipped, got %d runs", len(merged.Runs))
+	}
+}
+
+// fakeIdeScripts stubs runProductCmd and prepareProduct so
+// runQodanaLocalMultiProduct can be driven end-to-end without shelling out
+// to a real IDE or exercising guessProduct/setupLicenseManager/
+// installPlugins for real: prepareProduct becomes a no-op (so resolving a
+// product's backend doesn't hit the network or the filesystem), and each
+// "script" just drops a SARIF file into the ResultsDir it was invoked with
+// (the 7th argument, right after the fixed "inspect qodana --stub-profile
+// <path> <projectDir>" prefix) and returns the exit code configured for it.
+func fakeIdeScripts(t *testing.T, exitCodes map[string]int) {
+	t.Helper()
+	originalRunProductCmd := runProductCmd
+	originalPrepareProduct := prepareProduct
+	t.Cleanup(func() {
+		runProductCmd = originalRunProductCmd
+		prepareProduct = originalPrepareProduct
+	})
+	prepareProduct = func(*QodanaOptions) {}
+	runProductCmd = func(_ string, args ...string) int {
+		resultsDir := args[6]
+		product := filepath.Base(resultsDir)
+		writeFakeSarif(t, resultsDir, product)
+		return exitCodes[product]
+	}
+}
+
+// TestResolveProductArgsUsesPerProductBackend guards against each product
+// silently reusing whichever IDE backend a prior product (or the top-level
+// run) resolved: it stubs prepareProduct to resolve Prod from the opts it
+// was actually given, then asserts the args built for each product name its
+// own script rather than all converging on one.
+func TestResolveProductArgsUsesPerProductBackend(t *testing.T) {
+	originalPrepareProduct := prepareProduct
+	t.Cleanup(func() { prepareProduct = originalPrepareProduct })
+	prepareProduct = func(opts *QodanaOptions) {
+		Prod.IdeScript = opts.Ide + "-script"
+	}
+
+	var mu sync.Mutex
+	seenScripts := map[string]string{}
+	originalRunProductCmd := runProductCmd
+	t.Cleanup(func() { runProductCmd = originalRunProductCmd })
+	runProductCmd = func(_ string, args ...string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		product := filepath.Base(args[6])
+		seenScripts[product] = args[0]
+		return QodanaSuccessExitCode
+	}
+
+	base := t.TempDir()
+	opts := &QodanaOptions{
+		ProjectDir: base,
+		ResultsDir: filepath.Join(base, "results"),
+		CacheDir:   filepath.Join(base, "cache"),
+		Products:   []string{"QDJVM", "QDPY"},
+	}
+	runQodanaLocalMultiProduct(opts)
+
+	if seenScripts["QDJVM"] != "QDJVM-script" {
+		t.Errorf("expected QDJVM to resolve its own script, got '%s'", seenScripts["QDJVM"])
+	}
+	if seenScripts["QDPY"] != "QDPY-script" {
+		t.Errorf("expected QDPY to resolve its own script, got '%s'", seenScripts["QDPY"])
+	}
+}
+
+func TestRunQodanaLocalMultiProductPopulatesResultsDirs(t *testing.T) {
+	base := t.TempDir()
+	opts := &QodanaOptions{
+		ProjectDir: base,
+		ResultsDir: filepath.Join(base, "results"),
+		CacheDir:   filepath.Join(base, "cache"),
+		Products:   []string{"QDJVM", "QDPY"},
+	}
+	fakeIdeScripts(t, map[string]int{"QDJVM": QodanaSuccessExitCode, "QDPY": QodanaSuccessExitCode})
+
+	if got := runQodanaLocalMultiProduct(opts); got != QodanaSuccessExitCode {
+		t.Errorf("expected exit code %d, got %d", QodanaSuccessExitCode, got)
+	}
+
+	for _, product := range opts.Products {
+		resultsDir := filepath.Join(opts.ResultsDir, product)
+		if _, err := os.Stat(filepath.Join(resultsDir, "qodana.sarif.json")); err != nil {
+			t.Errorf("expected results dir for %s to be populated: %v", product, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(opts.ResultsDir, "qodana.sarif.json")); err != nil {
+		t.Errorf("expected merged SARIF to be written: %v", err)
+	}
+}
+
+func TestRunQodanaLocalMultiProductSurfacesFailThreshold(t *testing.T) {
+	base := t.TempDir()
+	opts := &QodanaOptions{
+		ProjectDir: base,
+		ResultsDir: filepath.Join(base, "results"),
+		CacheDir:   filepath.Join(base, "cache"),
+		Products:   []string{"QDJVM", "QDPY"},
+	}
+	fakeIdeScripts(t, map[string]int{"QDJVM": QodanaFailThresholdExitCode, "QDPY": QodanaFailThresholdExitCode})
+
+	if got := runQodanaLocalMultiProduct(opts); got != QodanaFailThresholdExitCode {
+		t.Errorf("expected every product hitting the fail threshold to surface %d, got %d", QodanaFailThresholdExitCode, got)
+	}
+}
+
+func TestAggregateExitCodes(t *testing.T) {
+	for _, testData := range []struct {
+		name    string
+		results []productResult
+		want    int
+	}{
+		{
+			name:    "all success",
+			results: []productResult{{exitCode: QodanaSuccessExitCode}, {exitCode: QodanaSuccessExitCode}},
+			want:    QodanaSuccessExitCode,
+		},
+		{
+			name:    "all fail threshold",
+			results: []productResult{{exitCode: QodanaFailThresholdExitCode}, {exitCode: QodanaFailThresholdExitCode}},
+			want:    QodanaFailThresholdExitCode,
+		},
+		{
+			name:    "fail threshold alongside success",
+			results: []productResult{{exitCode: QodanaFailThresholdExitCode}, {exitCode: QodanaSuccessExitCode}},
+			want:    QodanaFailThresholdExitCode,
+		},
+		{
+			name:    "a hard failure dominates the fail threshold",
+			results: []productResult{{exitCode: QodanaFailThresholdExitCode}, {exitCode: 1}},
+			want:    1,
+		},
+	} {
+		t.Run(testData.name, func(t *testing.T) {
+			if got := aggregateExitCodes(testData.results); got != testData.want {
+				t.Errorf("expected %d got %d", testData.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+/*
+ * Copyright 2021-2023 JetBrains s.r.o.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const marketplaceDownloadUrlTemplate = "https://plugins.jetbrains.com/plugin/download?pluginId=%s&version=%s"
+
+// pluginCache is a content-addressable store for downloaded plugin
+// artifacts, laid out the way Docker's image store addresses layers:
+// <root>/blobs/sha256/<digest>. A digest-addressed hit never touches the
+// network again.
+type pluginCache struct {
+	root string
+
+	// downloadURLOverride replaces the computed marketplace URL when set,
+	// so tests can point ensure/download at an httptest server instead of
+	// the real JetBrains Marketplace.
+	downloadURLOverride string
+}
+
+// newPluginCache returns a pluginCache rooted at cacheDir/plugins.
+func newPluginCache(cacheDir string) *pluginCache {
+	return &pluginCache{root: filepath.Join(cacheDir, "plugins")}
+}
+
+func (c *pluginCache) blobsDir() string {
+	return filepath.Join(c.root, "blobs", "sha256")
+}
+
+func (c *pluginCache) blobPath(digest string) string {
+	return filepath.Join(c.blobsDir(), digest)
+}
+
+// resolvedPlugin is one entry of the qodana.lock.yaml manifest.
+type resolvedPlugin struct {
+	Id      string `yaml:"id"`
+	Version string `yaml:"version"`
+	Sha256  string `yaml:"sha256"`
+}
+
+// lockFile is the reproducibility manifest written next to qodana.yaml.
+type lockFile struct {
+	Plugins []resolvedPlugin `yaml:"plugins"`
+}
+
+// ensure resolves plugin to a digest-addressed blob, downloading and
+// verifying it if it isn't already cached, and returns the local blob path
+// and the digest that was verified.
+func (c *pluginCache) ensure(plugin Plugin) (string, string, error) {
+	if plugin.Version == "" {
+		return "", "", fmt.Errorf("plugin %s has no version pinned, cannot resolve a reproducible download", plugin.Id)
+	}
+
+	if plugin.Sha256 != "" {
+		path := c.blobPath(plugin.Sha256)
+		if c.verifyCachedBlob(path, plugin.Sha256) {
+			log.Printf("Plugin %s@%s already in cache (sha256:%s)", plugin.Id, plugin.Version, plugin.Sha256)
+			return path, plugin.Sha256, nil
+		}
+	}
+
+	url := c.downloadURLOverride
+	if url == "" {
+		url = fmt.Sprintf(marketplaceDownloadUrlTemplate, plugin.Id, plugin.Version)
+	}
+	path, digest, err := c.download(url, plugin.Sha256)
+	if err != nil {
+		return "", "", err
+	}
+	return path, digest, nil
+}
+
+// verifyCachedBlob reports whether the blob at path still hashes to
+// expectedSha256, re-hashing on every cache hit instead of trusting
+// fileExists alone — a corrupted or tampered blob already resident in the
+// cache must not be served silently forever. A mismatch removes the blob so
+// ensure falls through to a fresh download rather than getting stuck behind
+// it on every subsequent run.
+func (c *pluginCache) verifyCachedBlob(path string, expectedSha256 string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, f); err != nil {
+		return false
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) == expectedSha256 {
+		return true
+	}
+	log.Warnf("Cached plugin blob at %s does not match its digest sha256:%s, re-downloading", path, expectedSha256)
+	_ = os.Remove(path)
+	return false
+}
+
+// download streams url into the blob store under a temp name, verifies its
+// digest against expectedSha256 (when non-empty) and only then atomically
+// renames it into place, so a crash or mismatch never leaves a corrupted
+// blob at its digest path.
+func (c *pluginCache) download(url string, expectedSha256 string) (string, string, error) {
+	if err := os.MkdirAll(c.blobsDir(), 0o755); err != nil {
+		return "", "", fmt.Errorf("failed to create plugin cache directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(c.blobsDir(), "download-*.tmp")
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create temp file for plugin download: %w", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	resp, err := http.Get(url)
+	if err != nil {
+		tmp.Close()
+		return "", "", fmt.Errorf("failed to download plugin from %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		tmp.Close()
+		return "", "", fmt.Errorf("failed to download plugin from %s: status %d", url, resp.StatusCode)
+	}
+
+	hasher := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(tmp, hasher), resp.Body); err != nil {
+		tmp.Close()
+		return "", "", fmt.Errorf("failed to save plugin download: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return "", "", fmt.Errorf("failed to save plugin download: %w", err)
+	}
+
+	digest := hex.EncodeToString(hasher.Sum(nil))
+	if expectedSha256 != "" && digest != expectedSha256 {
+		return "", "", fmt.Errorf("plugin digest mismatch: expected sha256:%s got sha256:%s", expectedSha256, digest)
+	}
+
+	dest := c.blobPath(digest)
+	if err = os.Rename(tmpPath, dest); err != nil {
+		return "", "", fmt.Errorf("failed to store plugin blob: %w", err)
+	}
+	return dest, digest, nil
+}
+
+// installFromCache links blobPath into pluginsDir under the plugin's id,
+// symlinking where the platform allows it and falling back to a copy.
+func installFromCache(blobPath string, pluginsDir string, pluginId string) error {
+	if err := os.MkdirAll(pluginsDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create plugins directory: %w", err)
+	}
+	dest := filepath.Join(pluginsDir, pluginId)
+	_ = os.Remove(dest)
+	if err := os.Symlink(blobPath, dest); err == nil {
+		return nil
+	}
+	return copyFile(blobPath, dest)
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// writePluginLockFile records the resolved id@version sha256:... tuples for
+// plugins so subsequent runs are reproducible and can cache-hit without any
+// network I/O.
+func writePluginLockFile(path string, plugins []resolvedPlugin) error {
+	data, err := yaml.Marshal(lockFile{Plugins: plugins})
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", path, err)
+	}
+	if err = os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// readPluginLockFile reads back the digests writePluginLockFile recorded,
+// keyed by "id@version", so a plugin pinned only by id/version in
+// qodana.yaml can still resolve to its cached blob on a later run. A missing
+// lock file is not an error: it just means nothing has been resolved yet.
+func readPluginLockFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	var lock lockFile
+	if err = yaml.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	digests := make(map[string]string, len(lock.Plugins))
+	for _, plugin := range lock.Plugins {
+		digests[plugin.Id+"@"+plugin.Version] = plugin.Sha256
+	}
+	return digests, nil
+}
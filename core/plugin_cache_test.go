@@ -0,0 +1,274 @@
+/*
+ * Copyright 2021-2023 JetBrains s.r.o.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPluginCacheEnsure(t *testing.T) {
+	artifact := []byte("fake plugin bytes")
+	sum := sha256.Sum256(artifact)
+	digest := hex.EncodeToString(sum[:])
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(artifact)
+	}))
+	defer svr.Close()
+
+	for _, testData := range []struct {
+		name        string
+		version     string
+		expectedSha string
+		wantErr     bool
+	}{
+		{
+			name:        "no digest supplied",
+			version:     "1.0",
+			expectedSha: "",
+			wantErr:     false,
+		},
+		{
+			name:        "matching digest",
+			version:     "1.0",
+			expectedSha: digest,
+			wantErr:     false,
+		},
+		{
+			name:        "mismatched digest",
+			version:     "1.0",
+			expectedSha: "0000000000000000000000000000000000000000000000000000000000000000",
+			wantErr:     true,
+		},
+		{
+			name:        "missing version",
+			version:     "",
+			expectedSha: "",
+			wantErr:     true,
+		},
+	} {
+		t.Run(testData.name, func(t *testing.T) {
+			cache := newPluginCache(t.TempDir())
+			cache.downloadURLOverride = svr.URL
+			plugin := Plugin{Id: "com.example.plugin", Version: testData.version, Sha256: testData.expectedSha}
+			path, gotDigest, err := cache.ensure(plugin)
+			if testData.wantErr {
+				if err == nil {
+					t.Fatal("expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if gotDigest != digest {
+				t.Errorf("expected digest '%s' got '%s'", digest, gotDigest)
+			}
+			if !fileExists(path) {
+				t.Errorf("expected blob to exist at %s", path)
+			}
+		})
+	}
+}
+
+func TestPluginCacheHitAvoidsNetwork(t *testing.T) {
+	artifact := []byte("cached plugin bytes")
+	sum := sha256.Sum256(artifact)
+	digest := hex.EncodeToString(sum[:])
+
+	cache := newPluginCache(t.TempDir())
+	if err := os.MkdirAll(cache.blobsDir(), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cache.blobPath(digest), artifact, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	requested := false
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+	}))
+	defer svr.Close()
+	cache.downloadURLOverride = svr.URL
+
+	plugin := Plugin{Id: "com.example.plugin", Version: "1.0", Sha256: digest}
+	path, gotDigest, err := cache.ensure(plugin)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if requested {
+		t.Error("expected a cache hit to skip the network download entirely")
+	}
+	if gotDigest != digest {
+		t.Errorf("expected digest '%s' got '%s'", digest, gotDigest)
+	}
+	if path != cache.blobPath(digest) {
+		t.Errorf("expected path '%s' got '%s'", cache.blobPath(digest), path)
+	}
+}
+
+func TestDownloadCorruptedBlobIsNotStored(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer svr.Close()
+
+	cache := newPluginCache(t.TempDir())
+	_, _, err := cache.download(svr.URL, "")
+	if err == nil {
+		t.Fatal("expected an error for a failed download")
+	}
+	entries, err := os.ReadDir(cache.blobsDir())
+	if err == nil {
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				t.Errorf("expected no blob to be stored after a failed download, found %s", entry.Name())
+			}
+		}
+	}
+}
+
+func TestPluginCacheCorruptedBlobIsRedownloaded(t *testing.T) {
+	staleBytes := []byte("corrupted on-disk bytes")
+	freshArtifact := []byte("fresh plugin bytes")
+	sum := sha256.Sum256(freshArtifact)
+	digest := hex.EncodeToString(sum[:])
+
+	cache := newPluginCache(t.TempDir())
+	if err := os.MkdirAll(cache.blobsDir(), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// Seed the cache with a blob at the expected digest's path whose
+	// contents don't actually hash to that digest, simulating on-disk
+	// corruption or tampering.
+	if err := os.WriteFile(cache.blobPath(digest), staleBytes, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	requested := false
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+		_, _ = w.Write(freshArtifact)
+	}))
+	defer svr.Close()
+	cache.downloadURLOverride = svr.URL
+
+	plugin := Plugin{Id: "com.example.plugin", Version: "1.0", Sha256: digest}
+	path, gotDigest, err := cache.ensure(plugin)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !requested {
+		t.Error("expected a corrupted cached blob to be re-downloaded instead of served as-is")
+	}
+	if gotDigest != digest {
+		t.Errorf("expected digest '%s' got '%s'", digest, gotDigest)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(freshArtifact) {
+		t.Error("expected the re-download to replace the corrupted blob")
+	}
+}
+
+func TestWritePluginLockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "qodana.lock.yaml")
+	plugins := []resolvedPlugin{
+		{Id: "com.example.plugin", Version: "1.0", Sha256: "abc123"},
+	}
+	if err := writePluginLockFile(path, plugins); err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(path) {
+		t.Fatalf("expected lock file to be written at %s", path)
+	}
+}
+
+func TestReadPluginLockFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "qodana.lock.yaml")
+	plugins := []resolvedPlugin{
+		{Id: "com.example.plugin", Version: "1.0", Sha256: "abc123"},
+	}
+	if err := writePluginLockFile(path, plugins); err != nil {
+		t.Fatal(err)
+	}
+
+	digests, err := readPluginLockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := digests["com.example.plugin@1.0"]; got != "abc123" {
+		t.Errorf("expected lock file read-back to resolve to 'abc123', got '%s'", got)
+	}
+}
+
+func TestReadPluginLockFileMissingIsNotAnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "qodana.lock.yaml")
+	digests, err := readPluginLockFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error for a missing lock file: %v", err)
+	}
+	if len(digests) != 0 {
+		t.Errorf("expected no digests from a missing lock file, got %v", digests)
+	}
+}
+
+func TestPluginCacheHitViaLockFileAvoidsNetwork(t *testing.T) {
+	artifact := []byte("locked plugin bytes")
+	sum := sha256.Sum256(artifact)
+	digest := hex.EncodeToString(sum[:])
+
+	cache := newPluginCache(t.TempDir())
+	if err := os.MkdirAll(cache.blobsDir(), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cache.blobPath(digest), artifact, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	requested := false
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+	}))
+	defer svr.Close()
+	cache.downloadURLOverride = svr.URL
+
+	lockPath := filepath.Join(t.TempDir(), "qodana.lock.yaml")
+	if err := writePluginLockFile(lockPath, []resolvedPlugin{{Id: "com.example.plugin", Version: "1.0", Sha256: digest}}); err != nil {
+		t.Fatal(err)
+	}
+	digests, err := readPluginLockFile(lockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plugin := Plugin{Id: "com.example.plugin", Version: "1.0", Sha256: digests["com.example.plugin@1.0"]}
+	if _, _, err = cache.ensure(plugin); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if requested {
+		t.Error("expected a lock-file-resolved digest to cache-hit without touching the network")
+	}
+}